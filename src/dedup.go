@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/singleflight"
+)
+
+// upscaleSemaphoreSize is how many upscale pipelines can run at once,
+// similar to the imageSemaphore/subredditSemaphore pattern: RealESRGAN
+// is GPU-bound, so letting every concurrent request run its own copy
+// will OOM or saturate the GPU. Defaults to 1.
+func upscaleSemaphoreSize() int {
+	raw := os.Getenv("APP_MAX_CONCURRENT_UPSCALES")
+	if raw == "" {
+		return 1
+	}
+
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		slog.Error("upscaleSemaphoreSize", "error", err, "value", raw)
+		return 1
+	}
+
+	return n
+}
+
+// newDedup builds the request-deduplication primitives shared by a
+// Router: a singleflight group so concurrent requests for the same
+// key share one in-flight download+upscale, and a semaphore so only
+// APP_MAX_CONCURRENT_UPSCALES pipelines run at a time.
+func newDedup() (*singleflight.Group, chan struct{}) {
+	return &singleflight.Group{}, make(chan struct{}, upscaleSemaphoreSize())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+// Format is an output image format this service can produce.
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatWebP Format = "webp"
+	FormatAVIF Format = "avif"
+)
+
+// MimeType returns the Content-Type to serve this format under.
+func (f Format) MimeType() string {
+	switch f {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatPNG:
+		return "image/png"
+	case FormatWebP:
+		return "image/webp"
+	case FormatAVIF:
+		return "image/avif"
+	default:
+		return "image/jpeg"
+	}
+}
+
+// Extension returns the file extension used for cache keys.
+func (f Format) Extension() string {
+	switch f {
+	case FormatJPEG:
+		return "jpg"
+	case FormatPNG:
+		return "png"
+	case FormatWebP:
+		return "webp"
+	case FormatAVIF:
+		return "avif"
+	default:
+		return "jpg"
+	}
+}
+
+// FormatFromExtension maps a stored key's file extension back to a
+// Format, for serving files whose bytes we don't want to re-sniff.
+func FormatFromExtension(ext string) Format {
+	switch strings.TrimPrefix(ext, ".") {
+	case "png":
+		return FormatPNG
+	case "webp":
+		return FormatWebP
+	case "avif":
+		return FormatAVIF
+	default:
+		return FormatJPEG
+	}
+}
+
+// DetectFormat sniffs the real format of the bytes, ignoring whatever
+// extension the source URL claimed to have. Only PNG and WebP are told
+// apart; any other bytes, including non-image data, are reported as JPEG.
+func DetectFormat(data []byte) Format {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return FormatPNG
+	case "image/webp":
+		return FormatWebP
+	default:
+		return FormatJPEG
+	}
+}
+
+// NegotiateFormat picks an output format from the request's Accept
+// header, preferring modern formats when the client advertises support
+// and falling back to JPEG otherwise. AVIF is intentionally never
+// negotiated: there's no pure-Go encoder for it, and advertising a
+// format we can't produce would mislabel the response's Content-Type.
+func NegotiateFormat(acceptHeader string) Format {
+	accept := strings.ToLower(acceptHeader)
+
+	switch {
+	case strings.Contains(accept, "image/webp"):
+		return FormatWebP
+	default:
+		return FormatJPEG
+	}
+}
+
+// encodeAs encodes img to the requested format. PNG and WebP get their
+// own encoders; every other format, AVIF included, is encoded as JPEG.
+func encodeAs(img image.Image, format Format) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case FormatPNG:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	case FormatWebP:
+		options, err := encoder.NewLossyEncoderOptions(encoder.PresetPhoto, 90)
+		if err != nil {
+			return nil, err
+		}
+		if err := webp.Encode(&buf, img, options); err != nil {
+			return nil, err
+		}
+	default:
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/exp/slog"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Processor is one step of the image processing chain. It reads src,
+// does its work, and returns a reader for the next step.
+type Processor interface {
+	Process(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error)
+}
+
+type pipelineState struct {
+	hitCache bool
+}
+
+type pipelineStateKey struct{}
+
+func withPipelineState(ctx context.Context) context.Context {
+	return context.WithValue(ctx, pipelineStateKey{}, &pipelineState{})
+}
+
+func pipelineStateFrom(ctx context.Context) *pipelineState {
+	state, ok := ctx.Value(pipelineStateKey{}).(*pipelineState)
+	if !ok {
+		return &pipelineState{}
+	}
+	return state
+}
+
+// Pipeline runs a sequence of Processors, feeding the output of one
+// into the next. A processor that marks the pipeline state as a cache
+// hit short-circuits the remaining steps.
+type Pipeline struct {
+	processors []Processor
+}
+
+func NewPipeline(processors ...Processor) *Pipeline {
+	return &Pipeline{processors: processors}
+}
+
+func (p *Pipeline) Run(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error) {
+	ctx = withPipelineState(ctx)
+	state := pipelineStateFrom(ctx)
+
+	current := src
+	for _, processor := range p.processors {
+		out, err := processor.Process(ctx, current, width, height)
+		if err != nil {
+			return nil, err
+		}
+
+		current = out
+
+		if state.hitCache {
+			break
+		}
+	}
+
+	return current, nil
+}
+
+// CacheProcessor short-circuits the rest of the chain when the final
+// output already exists in Storage for this key.
+type CacheProcessor struct {
+	Storage Storage
+	Key     string
+}
+
+func (c *CacheProcessor) Process(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error) {
+	exists, err := c.Storage.Stat(c.Key)
+	if err != nil {
+		slog.Error("CacheProcessor::stat", "error", err)
+		return nil, err
+	}
+	if !exists {
+		return src, nil
+	}
+
+	rc, err := c.Storage.Get(c.Key)
+	if err != nil {
+		slog.Error("CacheProcessor::get", "error", err)
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		slog.Error("CacheProcessor::read", "error", err)
+		return nil, err
+	}
+
+	pipelineStateFrom(ctx).hitCache = true
+
+	return bytes.NewReader(data), nil
+}
+
+// UpscaleProcessor runs RealESRGAN as a subprocess. It can be disabled
+// via APP_DISABLE_UPSCALE for environments without the binary, in
+// which case it passes the image through unchanged.
+type UpscaleProcessor struct {
+	BinaryPath string
+	Model      string
+	Scale      string
+	Disabled   bool
+}
+
+func (u *UpscaleProcessor) Process(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error) {
+	if u.Disabled {
+		return src, nil
+	}
+
+	inFile, err := os.CreateTemp("", "upscale-in-*.png")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(inFile.Name())
+	defer inFile.Close()
+
+	if _, err := io.Copy(inFile, src); err != nil {
+		slog.Error("UpscaleProcessor::write", "error", err)
+		return nil, err
+	}
+
+	outPath := strings.TrimSuffix(inFile.Name(), filepath.Ext(inFile.Name())) + "-out.png"
+	defer os.Remove(outPath)
+
+	cmd := exec.CommandContext(
+		ctx,
+		u.BinaryPath,
+		"-i", inFile.Name(),
+		"-o", outPath,
+		"-n", u.Model,
+		"-s", u.Scale,
+		"-f", "png",
+	)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		slog.Error("UpscaleProcessor::run", "error", err, "out", string(out))
+		return nil, fmt.Errorf("upscale: %w", err)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		slog.Error("UpscaleProcessor::read", "error", err)
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// ResizeProcessor resizes natively with golang.org/x/image/draw,
+// falling back to github.com/disintegration/imaging for formats draw
+// can't decode directly.
+type ResizeProcessor struct{}
+
+func (r *ResizeProcessor) Process(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error) {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		img, err = imaging.Decode(bytes.NewReader(data))
+		if err != nil {
+			slog.Error("ResizeProcessor::decode", "error", err)
+			return nil, err
+		}
+	}
+
+	// Scale to fit within width x height, preserving aspect ratio,
+	// the same behaviour as the replaced `convert -resize WxH`.
+	srcBounds := img.Bounds()
+	srcW, srcH := srcBounds.Dx(), srcBounds.Dy()
+	scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+	dstW := int(math.Round(float64(srcW) * scale))
+	dstH := int(math.Round(float64(srcH) * scale))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, srcBounds, draw.Over, nil)
+
+	return &imageBuffer{img: dst}, nil
+}
+
+// imageBuffer carries a decoded image to EncodeProcessor, which reads
+// img directly and owns the final format choice. Read exists only so
+// imageBuffer still satisfies io.Reader if some other step in the
+// chain ends up handling it instead; it encodes to JPEG lazily, once,
+// rather than up front on every image regardless of whether anything
+// reads it.
+type imageBuffer struct {
+	img image.Image
+
+	once   sync.Once
+	reader *bytes.Reader
+	encErr error
+}
+
+func (b *imageBuffer) Read(p []byte) (int, error) {
+	b.once.Do(func() {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, b.img, &jpeg.Options{Quality: 90}); err != nil {
+			b.encErr = err
+			return
+		}
+		b.reader = bytes.NewReader(buf.Bytes())
+	})
+
+	if b.encErr != nil {
+		return 0, b.encErr
+	}
+
+	return b.reader.Read(p)
+}
+
+// EncodeProcessor writes the final image out to bytes in the target
+// format, chosen by the caller from the request's Accept header.
+type EncodeProcessor struct {
+	Format Format
+}
+
+func (e *EncodeProcessor) Process(ctx context.Context, src io.Reader, width int, height int) (io.Reader, error) {
+	buf, ok := src.(*imageBuffer)
+	if !ok {
+		return src, nil
+	}
+
+	data, err := encodeAs(buf.img, e.Format)
+	if err != nil {
+		slog.Error("EncodeProcessor::encode", "error", err)
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
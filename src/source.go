@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// BasicAuth holds HTTP basic auth credentials for a Source's origin.
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Source is a named, configured image origin. Requests reference a
+// source by name (/api/{source_name}/{WxH}/{path}) instead of
+// embedding a host, so origins that need a scheme other than https,
+// a non-default port, or auth can still be used.
+type Source struct {
+	Name         string            `yaml:"name"`
+	BaseURL      string            `yaml:"base_url"`
+	Scheme       string            `yaml:"scheme"`
+	BasicAuth    *BasicAuth        `yaml:"basic_auth,omitempty"`
+	Headers      map[string]string `yaml:"headers,omitempty"`
+	RateLimitRPS float64           `yaml:"rate_limit_rps"`
+	TimeoutSec   int               `yaml:"timeout_seconds"`
+}
+
+func (s *Source) Timeout() time.Duration {
+	if s.TimeoutSec <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(s.TimeoutSec) * time.Second
+}
+
+type sourcesConfig struct {
+	Sources []Source `yaml:"sources"`
+}
+
+// SourceRegistry is the set of configured sources, each with its own
+// rate limiter, loaded once at startup from APP_SOURCES_CONFIG.
+type SourceRegistry struct {
+	sources  map[string]*Source
+	limiters map[string]*rate.Limiter
+}
+
+func LoadSourceRegistry(path string) (*SourceRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config sourcesConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	registry := &SourceRegistry{
+		sources:  make(map[string]*Source, len(config.Sources)),
+		limiters: make(map[string]*rate.Limiter, len(config.Sources)),
+	}
+
+	for i := range config.Sources {
+		source := config.Sources[i]
+		if source.Scheme == "" {
+			source.Scheme = "https"
+		}
+
+		registry.sources[source.Name] = &source
+
+		rps := source.RateLimitRPS
+		if rps <= 0 {
+			rps = 10
+		}
+		registry.limiters[source.Name] = rate.NewLimiter(rate.Limit(rps), 1)
+	}
+
+	return registry, nil
+}
+
+func (reg *SourceRegistry) Get(name string) (*Source, bool) {
+	source, ok := reg.sources[name]
+	return source, ok
+}
+
+func (reg *SourceRegistry) Limiter(name string) *rate.Limiter {
+	return reg.limiters[name]
+}
+
+// sourceRegistryFromEnv loads the registry from APP_SOURCES_CONFIG,
+// defaulting to ./sources.yaml.
+func sourceRegistryFromEnv() (*SourceRegistry, error) {
+	path := os.Getenv("APP_SOURCES_CONFIG")
+	if path == "" {
+		path = "./sources.yaml"
+	}
+
+	registry, err := LoadSourceRegistry(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading sources config %s: %w", path, err)
+	}
+
+	return registry, nil
+}
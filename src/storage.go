@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"golang.org/x/exp/slog"
+)
+
+// Storage is where processed (and raw, downloaded) images live. Keys
+// are slash-separated paths relative to whatever root the backend
+// manages, e.g. "1920x1080/af93e1.jpg".
+type Storage interface {
+	Stat(key string) (bool, error)
+	Get(key string) (io.ReadCloser, error)
+	Put(key string, r io.Reader) error
+	Delete(key string) error
+}
+
+// LocalStorage keeps images on the local filesystem under BaseDir.
+type LocalStorage struct {
+	BaseDir string
+}
+
+func NewLocalStorage(baseDir string) *LocalStorage {
+	return &LocalStorage{BaseDir: baseDir}
+}
+
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.BaseDir, key)
+}
+
+func (s *LocalStorage) Stat(key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LocalStorage) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *LocalStorage) Put(key string, r io.Reader) error {
+	path := s.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, r)
+	return err
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+// MemoryStorage is an in-process LRU cache for hot items. It holds at
+// most maxItems entries, evicts the least recently used one when full,
+// and keeps nothing on disk.
+type MemoryStorage struct {
+	cache *lru.Cache[string, []byte]
+	mu    sync.RWMutex
+}
+
+func NewMemoryStorage(maxItems int) (*MemoryStorage, error) {
+	cache, err := lru.New[string, []byte](maxItems)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStorage{cache: cache}, nil
+}
+
+func (s *MemoryStorage) Stat(key string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.cache.Get(key)
+	return ok, nil
+}
+
+func (s *MemoryStorage) Get(key string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.cache.Get(key)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStorage) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Add(key, data)
+
+	return nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Remove(key)
+	return nil
+}
+
+// S3Storage stores images in an S3-compatible bucket via minio-go,
+// letting multiple workers share the same cache.
+type S3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3Storage(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*S3Storage, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Storage{client: client, bucket: bucket}, nil
+}
+
+func (s *S3Storage) Stat(key string) (bool, error) {
+	_, err := s.client.StatObject(context.Background(), s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		errResponse := minio.ToErrorResponse(err)
+		if errResponse.Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *S3Storage) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		slog.Error("S3Storage::Get", "error", err)
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutObject(
+		context.Background(),
+		s.bucket,
+		key,
+		bytes.NewReader(data),
+		int64(len(data)),
+		minio.PutObjectOptions{},
+	)
+	return err
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// storageFromEnv builds the configured Storage backend. Defaults to
+// local filesystem storage under ./var, matching the service's prior
+// behaviour.
+func storageFromEnv() (Storage, error) {
+	switch os.Getenv("APP_STORAGE_BACKEND") {
+	case "s3":
+		return NewS3Storage(
+			os.Getenv("APP_S3_ENDPOINT"),
+			os.Getenv("APP_S3_ACCESS_KEY"),
+			os.Getenv("APP_S3_SECRET_KEY"),
+			os.Getenv("APP_S3_BUCKET"),
+			os.Getenv("APP_S3_USE_SSL") == "true",
+		)
+	case "memory":
+		return NewMemoryStorage(1024)
+	default:
+		return NewLocalStorage("./var"), nil
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/exp/slog"
+)
+
+type uploadResponse struct {
+	URL    string `json:"url"`
+	Hash   string `json:"hash"`
+	Size   int    `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Mime   string `json:"mime"`
+}
+
+func maxUploadBytes() int64 {
+	raw := os.Getenv("APP_MAX_UPLOAD_BYTES")
+	if raw == "" {
+		return 20 << 20 // 20 MiB
+	}
+
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		slog.Error("maxUploadBytes", "error", err, "value", raw)
+		return 20 << 20
+	}
+
+	return n
+}
+
+// HandleUpload accepts a multipart image upload, runs it through the
+// same processor chain as the proxy path, and stores it under a
+// content-addressed key (sha256 of the processed bytes, not a hash of
+// a filename, which can't collide the way pathFriendlyHash can).
+func (rtr *Router) HandleUpload(w http.ResponseWriter, r *http.Request) {
+	clientIP := r.RemoteAddr
+	slog.Info("HandleUpload", "ip", clientIP)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes())
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "File too large or malformed form", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	width, err := strconv.Atoi(r.FormValue("width"))
+	if err != nil {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+
+	height, err := strconv.Atoi(r.FormValue("height"))
+	if err != nil {
+		http.Error(w, "Invalid height", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading upload", http.StatusBadRequest)
+		return
+	}
+
+	// reject based on magic bytes, not the client-supplied filename/extension
+	switch http.DetectContentType(data) {
+	case "image/jpeg", "image/png", "image/webp":
+	default:
+		http.Error(w, "Unsupported image type", http.StatusUnsupportedMediaType)
+		return
+	}
+	format := DetectFormat(data)
+
+	pipeline := buildUploadPipeline(format)
+
+	out, err := pipeline.Run(r.Context(), bytes.NewReader(data), width, height)
+	if err != nil {
+		slog.Error("HandleUpload::pipeline", "error", err)
+		http.Error(w, "Error processing upload", http.StatusInternalServerError)
+		return
+	}
+
+	processed, err := io.ReadAll(out)
+	if err != nil {
+		slog.Error("HandleUpload::read", "error", err)
+		http.Error(w, "Error processing upload", http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.Sum256(processed)
+	hexHash := hex.EncodeToString(hash[:])
+	key := fmt.Sprintf("uploads/%s.%s", hexHash, format.Extension())
+
+	if err := rtr.storage.Put(key, bytes.NewReader(processed)); err != nil {
+		slog.Error("HandleUpload::put", "error", err)
+		http.Error(w, "Error storing upload", http.StatusInternalServerError)
+		return
+	}
+
+	response := uploadResponse{
+		URL:    "/" + key,
+		Hash:   hexHash,
+		Size:   len(processed),
+		Width:  width,
+		Height: height,
+		Mime:   format.MimeType(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleDownload serves a key written by HandleUpload back out of
+// Storage, so the URLs that upload responses hand out are servable.
+func (rtr *Router) HandleDownload(w http.ResponseWriter, r *http.Request, key string) {
+	rc, err := rtr.storage.Get(key)
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		slog.Error("HandleDownload::read", "error", err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+
+	format := FormatFromExtension(filepath.Ext(key))
+	w.Header().Set("Content-Type", format.MimeType())
+	w.Write(data)
+}
+
+// buildUploadPipeline skips CacheProcessor: a freshly uploaded image
+// has no cache key to check yet.
+func buildUploadPipeline(format Format) *Pipeline {
+	return NewPipeline(
+		&UpscaleProcessor{
+			BinaryPath: "./lib/realesr/realesrgan-ncnn-vulkan",
+			Model:      "realesrgan-x4plus",
+			Scale:      "4",
+			Disabled:   os.Getenv("APP_DISABLE_UPSCALE") == "true",
+		},
+		&ResizeProcessor{},
+		&EncodeProcessor{Format: format},
+	)
+}